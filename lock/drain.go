@@ -0,0 +1,294 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	etcd "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	etcd3 "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/clientv3"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+const defaultDrainKey = "/coreos.com/updateengine/rebootlock/drain"
+
+var (
+	// ErrDrainExist is returned by AcquireDrain when a drain lock with the
+	// given name is already held.
+	ErrDrainExist = errors.New("lock: a drain lock with that name is already held")
+	// ErrDrainNotExist is returned by ReleaseDrain when no drain lock with
+	// the given name is held.
+	ErrDrainNotExist = errors.New("lock: no drain lock with that name is held")
+)
+
+// DrainHolder describes one shared drain lock: a non-exclusive hold that
+// blocks reboots cluster-wide without requiring its holder to take a
+// reboot slot itself, e.g. a kubelet drain script or backup job running
+// somewhere in the cluster.
+type DrainHolder struct {
+	Name       string    `json:"name"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+// drainSet is the JSON value stored at the drain key in etcd.
+type drainSet struct {
+	Holders []DrainHolder `json:"holders"`
+}
+
+func (d *drainSet) held(name string) bool {
+	for _, h := range d.Holders {
+		if h.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *drainSet) release(name string) {
+	holders := d.Holders[:0]
+	for _, h := range d.Holders {
+		if h.Name != name {
+			holders = append(holders, h)
+		}
+	}
+	d.Holders = holders
+}
+
+// DrainChecker is implemented by the etcd-backed reboot locks, letting
+// rebooter.lockAndReboot hold off taking the exclusive reboot slot while a
+// shared drain lock is held by anything in the cluster.
+type DrainChecker interface {
+	DrainActive() (bool, error)
+}
+
+func (l *Lock) getDrain() (*drainSet, uint64, error) {
+	resp, err := l.etcd.Get(context.Background(), defaultDrainKey, nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return &drainSet{}, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	var d drainSet
+	if err := json.Unmarshal([]byte(resp.Node.Value), &d); err != nil {
+		return nil, 0, err
+	}
+
+	return &d, resp.Node.ModifiedIndex, nil
+}
+
+// DrainActive reports whether any shared drain lock is currently held
+// against this Lock's etcd v2 cluster.
+func (l *Lock) DrainActive() (bool, error) {
+	d, _, err := l.getDrain()
+	if err != nil {
+		return false, err
+	}
+	return len(d.Holders) > 0, nil
+}
+
+// AcquireDrain takes a shared drain lock under name, blocking
+// rebooter.lockAndReboot from taking the exclusive reboot slot until
+// ReleaseDrain is called with the same name. It returns ErrDrainExist if
+// name is already held.
+func AcquireDrain(etcdClient etcd.KeysAPI, name string) error {
+	l := &Lock{etcd: etcdClient}
+	for {
+		d, index, err := l.getDrain()
+		if err != nil {
+			return err
+		}
+
+		if d.held(name) {
+			return ErrDrainExist
+		}
+
+		d.Holders = append(d.Holders, DrainHolder{Name: name, AcquiredAt: time.Now()})
+		body, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		opts := &etcd.SetOptions{PrevIndex: index}
+		if index == 0 {
+			opts.PrevExist = etcd.PrevNoExist
+		}
+
+		if _, err := etcdClient.Set(context.Background(), defaultDrainKey, string(body), opts); err != nil {
+			if cerr, ok := err.(etcd.Error); ok && cerr.Code == etcd.ErrorCodeTestFailed {
+				continue
+			}
+			return err
+		}
+
+		return nil
+	}
+}
+
+// ReleaseDrain releases the shared drain lock held under name. It returns
+// ErrDrainNotExist if no such lock is held.
+func ReleaseDrain(etcdClient etcd.KeysAPI, name string) error {
+	l := &Lock{etcd: etcdClient}
+	for {
+		d, index, err := l.getDrain()
+		if err != nil {
+			return err
+		}
+
+		if !d.held(name) {
+			return ErrDrainNotExist
+		}
+		d.release(name)
+
+		body, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		opts := &etcd.SetOptions{PrevIndex: index}
+		if _, err := etcdClient.Set(context.Background(), defaultDrainKey, string(body), opts); err != nil {
+			if cerr, ok := err.(etcd.Error); ok && cerr.Code == etcd.ErrorCodeTestFailed {
+				continue
+			}
+			return err
+		}
+
+		return nil
+	}
+}
+
+// ListDrain returns the names currently holding a shared drain lock against
+// an etcd v2 cluster.
+func ListDrain(etcdClient etcd.KeysAPI) ([]DrainHolder, error) {
+	l := &Lock{etcd: etcdClient}
+	d, _, err := l.getDrain()
+	if err != nil {
+		return nil, err
+	}
+	return d.Holders, nil
+}
+
+func (l *LockV3) getDrain(ctx context.Context) (*drainSet, int64, error) {
+	resp, err := l.client.Get(ctx, defaultDrainKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return &drainSet{}, 0, nil
+	}
+
+	var d drainSet
+	if err := json.Unmarshal(resp.Kvs[0].Value, &d); err != nil {
+		return nil, 0, err
+	}
+
+	return &d, resp.Kvs[0].ModRevision, nil
+}
+
+// DrainActive reports whether any shared drain lock is currently held
+// against this Lock's etcd v3 cluster.
+func (l *LockV3) DrainActive() (bool, error) {
+	d, _, err := l.getDrain(context.Background())
+	if err != nil {
+		return false, err
+	}
+	return len(d.Holders) > 0, nil
+}
+
+// AcquireDrainV3 is AcquireDrain against an etcd v3 cluster.
+func AcquireDrainV3(client *etcd3.Client, name string) error {
+	ctx := context.Background()
+	l := &LockV3{client: client}
+
+	for {
+		d, modRevision, err := l.getDrain(ctx)
+		if err != nil {
+			return err
+		}
+
+		if d.held(name) {
+			return ErrDrainExist
+		}
+
+		d.Holders = append(d.Holders, DrainHolder{Name: name, AcquiredAt: time.Now()})
+		body, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		txn, err := client.Txn(ctx).
+			If(etcd3.Compare(etcd3.ModRevision(defaultDrainKey), "=", modRevision)).
+			Then(etcd3.OpPut(defaultDrainKey, string(body))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !txn.Succeeded {
+			continue
+		}
+
+		return nil
+	}
+}
+
+// ReleaseDrainV3 is ReleaseDrain against an etcd v3 cluster.
+func ReleaseDrainV3(client *etcd3.Client, name string) error {
+	ctx := context.Background()
+	l := &LockV3{client: client}
+
+	for {
+		d, modRevision, err := l.getDrain(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !d.held(name) {
+			return ErrDrainNotExist
+		}
+		d.release(name)
+
+		body, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		txn, err := client.Txn(ctx).
+			If(etcd3.Compare(etcd3.ModRevision(defaultDrainKey), "=", modRevision)).
+			Then(etcd3.OpPut(defaultDrainKey, string(body))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !txn.Succeeded {
+			continue
+		}
+
+		return nil
+	}
+}
+
+// ListDrainV3 returns the names currently holding a shared drain lock
+// against an etcd v3 cluster.
+func ListDrainV3(client *etcd3.Client) ([]DrainHolder, error) {
+	l := &LockV3{client: client}
+	d, _, err := l.getDrain(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return d.Holders, nil
+}
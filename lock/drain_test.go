@@ -0,0 +1,261 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDrainSetHeld(t *testing.T) {
+	d := &drainSet{Holders: []DrainHolder{
+		{Name: "kubelet-drain", AcquiredAt: time.Now()},
+	}}
+
+	if !d.held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be held")
+	}
+	if d.held("backup-job") {
+		t.Error("did not expect backup-job to be held")
+	}
+}
+
+func TestDrainSetRelease(t *testing.T) {
+	d := &drainSet{Holders: []DrainHolder{
+		{Name: "kubelet-drain", AcquiredAt: time.Now()},
+		{Name: "backup-job", AcquiredAt: time.Now()},
+	}}
+
+	d.release("kubelet-drain")
+
+	if d.held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be released")
+	}
+	if !d.held("backup-job") {
+		t.Error("releasing one holder should not affect another")
+	}
+	if len(d.Holders) != 1 {
+		t.Errorf("expected 1 remaining holder, got %d", len(d.Holders))
+	}
+}
+
+func TestDrainSetReleaseUnknownIsNoop(t *testing.T) {
+	d := &drainSet{Holders: []DrainHolder{
+		{Name: "kubelet-drain", AcquiredAt: time.Now()},
+	}}
+
+	d.release("never-held")
+
+	if !d.held("kubelet-drain") {
+		t.Error("releasing a name that was never held should not affect existing holders")
+	}
+}
+
+func (f *fakeKeysAPI) drainSet(t *testing.T) drainSet {
+	t.Helper()
+	var d drainSet
+	if !f.exists {
+		return d
+	}
+	if err := json.Unmarshal([]byte(f.value), &d); err != nil {
+		t.Fatalf("corrupt drain set written: %v", err)
+	}
+	return d
+}
+
+func TestAcquireDrainAcquiresLock(t *testing.T) {
+	ec := &fakeKeysAPI{}
+
+	if err := AcquireDrain(ec, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrain() = %v, want nil", err)
+	}
+	if !ec.drainSet(t).held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be held after AcquireDrain")
+	}
+}
+
+func TestAcquireDrainReturnsErrDrainExistIfAlreadyHeld(t *testing.T) {
+	ec := &fakeKeysAPI{}
+
+	if err := AcquireDrain(ec, "kubelet-drain"); err != nil {
+		t.Fatalf("first AcquireDrain() = %v, want nil", err)
+	}
+	if err := AcquireDrain(ec, "kubelet-drain"); err != ErrDrainExist {
+		t.Errorf("second AcquireDrain() = %v, want ErrDrainExist", err)
+	}
+}
+
+func TestAcquireDrainRetriesOnCASFailure(t *testing.T) {
+	ec := &fakeKeysAPI{casFailures: 2}
+
+	if err := AcquireDrain(ec, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrain() = %v, want nil after retrying past CAS failures", err)
+	}
+	if !ec.drainSet(t).held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be held once AcquireDrain stopped retrying")
+	}
+}
+
+func TestReleaseDrainReleasesLock(t *testing.T) {
+	ec := &fakeKeysAPI{}
+
+	if err := AcquireDrain(ec, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrain() = %v, want nil", err)
+	}
+	if err := ReleaseDrain(ec, "kubelet-drain"); err != nil {
+		t.Fatalf("ReleaseDrain() = %v, want nil", err)
+	}
+	if ec.drainSet(t).held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be released after ReleaseDrain")
+	}
+}
+
+func TestReleaseDrainReturnsErrDrainNotExistIfNotHeld(t *testing.T) {
+	ec := &fakeKeysAPI{}
+
+	if err := ReleaseDrain(ec, "kubelet-drain"); err != ErrDrainNotExist {
+		t.Errorf("ReleaseDrain() = %v, want ErrDrainNotExist", err)
+	}
+}
+
+func TestReleaseDrainRetriesOnCASFailure(t *testing.T) {
+	ec := &fakeKeysAPI{}
+
+	if err := AcquireDrain(ec, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrain() = %v, want nil", err)
+	}
+
+	ec.casFailures = 2
+	if err := ReleaseDrain(ec, "kubelet-drain"); err != nil {
+		t.Fatalf("ReleaseDrain() = %v, want nil after retrying past CAS failures", err)
+	}
+	if ec.drainSet(t).held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be released once ReleaseDrain stopped retrying")
+	}
+}
+
+func TestAcquireDrainV3AcquiresLock(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+
+	if err := AcquireDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrainV3() = %v, want nil", err)
+	}
+	if !kv.drainSet(t).held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be held after AcquireDrainV3")
+	}
+}
+
+func TestAcquireDrainV3ReturnsErrDrainExistIfAlreadyHeld(t *testing.T) {
+	client, _, _ := newFakeClient3()
+
+	if err := AcquireDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("first AcquireDrainV3() = %v, want nil", err)
+	}
+	if err := AcquireDrainV3(client, "kubelet-drain"); err != ErrDrainExist {
+		t.Errorf("second AcquireDrainV3() = %v, want ErrDrainExist", err)
+	}
+}
+
+func TestAcquireDrainV3RetriesOnCASFailure(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+	kv.casFailures = 2
+
+	if err := AcquireDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrainV3() = %v, want nil after retrying past CAS failures", err)
+	}
+	if !kv.drainSet(t).held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be held once AcquireDrainV3 stopped retrying")
+	}
+}
+
+func TestReleaseDrainV3ReleasesLock(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+
+	if err := AcquireDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrainV3() = %v, want nil", err)
+	}
+	if err := ReleaseDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("ReleaseDrainV3() = %v, want nil", err)
+	}
+	if kv.drainSet(t).held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be released after ReleaseDrainV3")
+	}
+}
+
+func TestReleaseDrainV3ReturnsErrDrainNotExistIfNotHeld(t *testing.T) {
+	client, _, _ := newFakeClient3()
+
+	if err := ReleaseDrainV3(client, "kubelet-drain"); err != ErrDrainNotExist {
+		t.Errorf("ReleaseDrainV3() = %v, want ErrDrainNotExist", err)
+	}
+}
+
+func TestReleaseDrainV3RetriesOnCASFailure(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+
+	if err := AcquireDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrainV3() = %v, want nil", err)
+	}
+
+	kv.casFailures = 2
+	if err := ReleaseDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("ReleaseDrainV3() = %v, want nil after retrying past CAS failures", err)
+	}
+	if kv.drainSet(t).held("kubelet-drain") {
+		t.Error("expected kubelet-drain to be released once ReleaseDrainV3 stopped retrying")
+	}
+}
+
+func TestListDrainV3ReturnsCurrentHolders(t *testing.T) {
+	client, _, _ := newFakeClient3()
+
+	if err := AcquireDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrainV3() = %v, want nil", err)
+	}
+
+	holders, err := ListDrainV3(client)
+	if err != nil {
+		t.Fatalf("ListDrainV3() = %v, want nil", err)
+	}
+	if len(holders) != 1 || holders[0].Name != "kubelet-drain" {
+		t.Errorf("ListDrainV3() = %v, want a single kubelet-drain holder", holders)
+	}
+}
+
+func TestLockV3DrainActive(t *testing.T) {
+	client, _, _ := newFakeClient3()
+	l := &LockV3{client: client}
+
+	active, err := l.DrainActive()
+	if err != nil {
+		t.Fatalf("DrainActive() = %v, want nil", err)
+	}
+	if active {
+		t.Error("expected DrainActive() to be false with no drain locks held")
+	}
+
+	if err := AcquireDrainV3(client, "kubelet-drain"); err != nil {
+		t.Fatalf("AcquireDrainV3() = %v, want nil", err)
+	}
+
+	active, err = l.DrainActive()
+	if err != nil {
+		t.Fatalf("DrainActive() = %v, want nil", err)
+	}
+	if !active {
+		t.Error("expected DrainActive() to be true once a drain lock is held")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"time"
+
+	etcd "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	etcd3 "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/clientv3"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+const (
+	heartbeatPrefix = "/coreos.com/updateengine/rebootlock/heartbeat/"
+	// HeartbeatTTL is how long, in seconds, a published heartbeat is valid
+	// for before it must be refreshed. locksmithctl locks --stale treats a
+	// holder whose heartbeat has expired, or never matched its OwnerUID, as
+	// abandoned.
+	HeartbeatTTL int64 = 30
+)
+
+// HeartbeatKey returns the etcd key locksmithd publishes its liveness
+// heartbeat to for the given machine-id.
+func HeartbeatKey(machineID string) string {
+	return heartbeatPrefix + machineID
+}
+
+// RefreshHeartbeat publishes ownerUID as the current heartbeat for
+// machineID against an etcd v2 cluster, expiring after HeartbeatTTL unless
+// refreshed again.
+func RefreshHeartbeat(ec etcd.KeysAPI, machineID, ownerUID string) error {
+	opts := &etcd.SetOptions{TTL: time.Duration(HeartbeatTTL) * time.Second}
+	_, err := ec.Set(context.Background(), HeartbeatKey(machineID), ownerUID, opts)
+	return err
+}
+
+// GetHeartbeat returns the OwnerUID currently heartbeating for machineID
+// against an etcd v2 cluster, or "" if none is published.
+func GetHeartbeat(ec etcd.KeysAPI, machineID string) (string, error) {
+	resp, err := ec.Get(context.Background(), HeartbeatKey(machineID), nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return resp.Node.Value, nil
+}
+
+// RefreshHeartbeatV3 publishes ownerUID as the current heartbeat for
+// machineID against an etcd v3 cluster, attached to a short-lived lease so
+// it disappears on its own if locksmithd stops refreshing it.
+func RefreshHeartbeatV3(ec *etcd3.Client, machineID, ownerUID string) error {
+	ctx := context.Background()
+
+	lease, err := ec.Grant(ctx, HeartbeatTTL)
+	if err != nil {
+		return err
+	}
+
+	_, err = ec.Put(ctx, HeartbeatKey(machineID), ownerUID, etcd3.WithLease(lease.ID))
+	return err
+}
+
+// GetHeartbeatV3 returns the OwnerUID currently heartbeating for machineID
+// against an etcd v3 cluster, or "" if none is published.
+func GetHeartbeatV3(ec *etcd3.Client, machineID string) (string, error) {
+	resp, err := ec.Get(context.Background(), HeartbeatKey(machineID))
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import "testing"
+
+func TestHeartbeatKey(t *testing.T) {
+	if got, want := HeartbeatKey("machine-a"), heartbeatPrefix+"machine-a"; got != want {
+		t.Errorf("HeartbeatKey() = %q, want %q", got, want)
+	}
+}
+
+func TestRefreshAndGetHeartbeat(t *testing.T) {
+	ec := &fakeKeysAPI{}
+
+	if err := RefreshHeartbeat(ec, "machine-a", "owner-1"); err != nil {
+		t.Fatalf("RefreshHeartbeat() = %v, want nil", err)
+	}
+
+	got, err := GetHeartbeat(ec, "machine-a")
+	if err != nil {
+		t.Fatalf("GetHeartbeat() = %v, want nil", err)
+	}
+	if got != "owner-1" {
+		t.Errorf("GetHeartbeat() = %q, want %q", got, "owner-1")
+	}
+}
+
+func TestGetHeartbeatReturnsEmptyIfUnpublished(t *testing.T) {
+	ec := &fakeKeysAPI{}
+
+	got, err := GetHeartbeat(ec, "machine-a")
+	if err != nil {
+		t.Fatalf("GetHeartbeat() = %v, want nil", err)
+	}
+	if got != "" {
+		t.Errorf("GetHeartbeat() = %q, want empty", got)
+	}
+}
+
+func TestRefreshHeartbeatOverwritesPreviousOwner(t *testing.T) {
+	ec := &fakeKeysAPI{}
+
+	if err := RefreshHeartbeat(ec, "machine-a", "owner-1"); err != nil {
+		t.Fatalf("RefreshHeartbeat() = %v, want nil", err)
+	}
+	if err := RefreshHeartbeat(ec, "machine-a", "owner-2"); err != nil {
+		t.Fatalf("RefreshHeartbeat() = %v, want nil", err)
+	}
+
+	got, err := GetHeartbeat(ec, "machine-a")
+	if err != nil {
+		t.Fatalf("GetHeartbeat() = %v, want nil", err)
+	}
+	if got != "owner-2" {
+		t.Errorf("GetHeartbeat() = %q, want %q", got, "owner-2")
+	}
+}
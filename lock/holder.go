@@ -0,0 +1,119 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Holder describes a single machine's slot in the reboot semaphore, along
+// with enough detail about the locksmithd which acquired it to diagnose a
+// stuck reboot lock without having to log into the holding machine.
+type Holder struct {
+	MachineID     string    `json:"machineID"`
+	Hostname      string    `json:"hostname"`
+	PID           int       `json:"pid"`
+	KernelVersion string    `json:"kernelVersion"`
+	OSVersion     string    `json:"osVersion"`
+	AcquiredAt    time.Time `json:"acquiredAt"`
+	// OwnerUID identifies the particular locksmithd incarnation that
+	// acquired this slot, chosen fresh each time locksmithd starts. It is
+	// compared against the heartbeat published for MachineID so a stale
+	// entry left by a previous incarnation can be told apart from one held
+	// by the currently running daemon.
+	OwnerUID string `json:"ownerUID"`
+}
+
+// newHolder builds a Holder describing this host and process, acquiring
+// machineID's slot under ownerUID.
+func newHolder(machineID, ownerUID string) Holder {
+	hostname, _ := os.Hostname()
+	kernel, _ := kernelVersion()
+
+	return Holder{
+		MachineID:     machineID,
+		Hostname:      hostname,
+		PID:           os.Getpid(),
+		KernelVersion: kernel,
+		OSVersion:     osVersion(),
+		AcquiredAt:    time.Now(),
+		OwnerUID:      ownerUID,
+	}
+}
+
+// NewOwnerUID returns a fresh, random identifier for one locksmithd
+// incarnation, to be reused for every slot it acquires and for the
+// heartbeat it publishes while running.
+func NewOwnerUID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		// crypto/rand failing means the system is in serious trouble; fall
+		// back to a fixed but still-usable identifier rather than panic.
+		return "00000000"
+	}
+	return fmt.Sprintf("%x", buf)
+}
+
+// kernelVersion returns the running kernel's release, e.g. "4.1.7-coreos".
+func kernelVersion() (string, error) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return "", err
+	}
+	return utsString(uts.Release[:]), nil
+}
+
+func utsString(field []int8) string {
+	b := make([]byte, 0, len(field))
+	for _, c := range field {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
+
+// osVersion reads the VERSION field out of /etc/os-release, CoreOS's usual
+// place for the current OS version. It returns "" if unreadable rather than
+// erroring, since this is only used to annotate lock holders for humans.
+func osVersion() string {
+	return osVersionFile("/etc/os-release")
+}
+
+// osVersionFile is osVersion parameterized on the os-release path, broken
+// out so tests can point it at a fabricated file instead of the real one.
+func osVersionFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "VERSION=") {
+			continue
+		}
+		v := strings.TrimPrefix(line, "VERSION=")
+		return strings.Trim(v, `"`)
+	}
+
+	return ""
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUtsString(t *testing.T) {
+	field := make([]int8, 65)
+	for i, c := range "4.1.7-coreos" {
+		field[i] = int8(c)
+	}
+
+	if got, want := utsString(field), "4.1.7-coreos"; got != want {
+		t.Errorf("utsString() = %q, want %q", got, want)
+	}
+}
+
+func TestUtsStringEmpty(t *testing.T) {
+	if got := utsString(make([]int8, 65)); got != "" {
+		t.Errorf("utsString() = %q, want empty", got)
+	}
+}
+
+func TestOSVersionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-osversion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "os-release")
+	content := "NAME=\"CoreOS\"\nVERSION=1234.0.0\nID=coreos\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := osVersionFile(path), "1234.0.0"; got != want {
+		t.Errorf("osVersionFile() = %q, want %q", got, want)
+	}
+}
+
+func TestOSVersionFileQuoted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locksmith-osversion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "os-release")
+	content := "VERSION=\"1234.0.0\"\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := osVersionFile(path), "1234.0.0"; got != want {
+		t.Errorf("osVersionFile() = %q, want %q", got, want)
+	}
+}
+
+func TestOSVersionFileMissing(t *testing.T) {
+	if got := osVersionFile("/nonexistent/os-release"); got != "" {
+		t.Errorf("osVersionFile() = %q, want empty for an unreadable file", got)
+	}
+}
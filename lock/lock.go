@@ -0,0 +1,199 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lock implements a distributed semaphore, backed by etcd, used to
+// serialize reboots of machines which share an etcd cluster.
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	etcd "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+const (
+	defaultSemaphoreKey = "/coreos.com/updateengine/rebootlock/semaphore"
+	defaultMax          = 1
+)
+
+var (
+	// ErrExist is returned by Lock when this machine already holds a slot
+	// in the semaphore.
+	ErrExist = errors.New("lock: machine already holds a lock")
+	// ErrNotExist is returned by Unlock when this machine does not hold a
+	// slot in the semaphore.
+	ErrNotExist = errors.New("lock: machine does not hold a lock")
+)
+
+// Locker is implemented by the etcd-backed reboot locks. setupLock hands
+// callers a Locker rather than a concrete type so that daemon.go does not
+// need to know which etcd API version backs the lock it was handed.
+type Locker interface {
+	Lock() error
+	Unlock() error
+}
+
+// semaphore is the JSON value stored at the semaphore key in etcd.
+type semaphore struct {
+	Semaphore int      `json:"semaphore"`
+	Max       int      `json:"max"`
+	Holders   []Holder `json:"holders"`
+}
+
+func (s *semaphore) held(machineID string) bool {
+	_, ok := s.holder(machineID)
+	return ok
+}
+
+func (s *semaphore) holder(machineID string) (*Holder, bool) {
+	for i := range s.Holders {
+		if s.Holders[i].MachineID == machineID {
+			return &s.Holders[i], true
+		}
+	}
+	return nil, false
+}
+
+func (s *semaphore) release(machineID string) {
+	holders := s.Holders[:0]
+	for _, h := range s.Holders {
+		if h.MachineID != machineID {
+			holders = append(holders, h)
+		}
+	}
+	s.Holders = holders
+}
+
+// Lock is a reboot semaphore held by a single machine, identified by its
+// machine-id, against an etcd v2 cluster.
+type Lock struct {
+	id       string
+	ownerUID string
+	key      string
+	etcd     etcd.KeysAPI
+}
+
+// New returns a Lock for the given machine-id backed by the given etcd v2
+// client. ownerUID identifies this locksmithd incarnation and is recorded
+// alongside the slot it acquires so stale entries left by a previous
+// incarnation on the same machine-id can be told apart from a live one; see
+// NewOwnerUID and the heartbeat published by locksmithd.
+func New(machineID, ownerUID string, etcdClient etcd.KeysAPI) *Lock {
+	return &Lock{
+		id:       machineID,
+		ownerUID: ownerUID,
+		key:      defaultSemaphoreKey,
+		etcd:     etcdClient,
+	}
+}
+
+func (l *Lock) get() (*semaphore, uint64, error) {
+	resp, err := l.etcd.Get(context.Background(), l.key, nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return &semaphore{Max: defaultMax}, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	var sem semaphore
+	if err := json.Unmarshal([]byte(resp.Node.Value), &sem); err != nil {
+		return nil, 0, err
+	}
+
+	return &sem, resp.Node.ModifiedIndex, nil
+}
+
+// Lock attempts to acquire a slot in the semaphore for this machine. It
+// returns ErrExist if this machine already holds a slot, or an error if the
+// semaphore is full.
+func (l *Lock) Lock() error {
+	for {
+		sem, index, err := l.get()
+		if err != nil {
+			return err
+		}
+
+		if sem.held(l.id) {
+			return ErrExist
+		}
+		if len(sem.Holders) >= sem.Max {
+			return fmt.Errorf("lock: semaphore full (%d/%d)", len(sem.Holders), sem.Max)
+		}
+
+		sem.Holders = append(sem.Holders, newHolder(l.id, l.ownerUID))
+		body, err := json.Marshal(sem)
+		if err != nil {
+			return err
+		}
+
+		opts := &etcd.SetOptions{PrevIndex: index}
+		if index == 0 {
+			opts.PrevExist = etcd.PrevNoExist
+		}
+
+		if _, err := l.etcd.Set(context.Background(), l.key, string(body), opts); err != nil {
+			if cerr, ok := err.(etcd.Error); ok && cerr.Code == etcd.ErrorCodeTestFailed {
+				continue
+			}
+			return err
+		}
+
+		return nil
+	}
+}
+
+// Unlock releases this machine's slot in the semaphore, if held.
+func (l *Lock) Unlock() error {
+	for {
+		sem, index, err := l.get()
+		if err != nil {
+			return err
+		}
+
+		if !sem.held(l.id) {
+			return ErrNotExist
+		}
+		sem.release(l.id)
+
+		body, err := json.Marshal(sem)
+		if err != nil {
+			return err
+		}
+
+		opts := &etcd.SetOptions{PrevIndex: index}
+		if _, err := l.etcd.Set(context.Background(), l.key, string(body), opts); err != nil {
+			if cerr, ok := err.(etcd.Error); ok && cerr.Code == etcd.ErrorCodeTestFailed {
+				continue
+			}
+			return err
+		}
+
+		return nil
+	}
+}
+
+// List returns the current holders of the reboot semaphore in an etcd v2
+// cluster, for locksmithctl locks to print.
+func List(etcdClient etcd.KeysAPI) ([]Holder, error) {
+	l := &Lock{key: defaultSemaphoreKey, etcd: etcdClient}
+	sem, _, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	return sem.Holders, nil
+}
@@ -0,0 +1,266 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+
+	etcd3 "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/clientv3"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// defaultLeaseTTL is how long, in seconds, a reboot slot survives without a
+// keepalive before etcd expires it. It only needs to outlast the interval
+// between keepalive heartbeats, not the reboot itself: a crash or a reboot
+// stops the heartbeats immediately and the slot is freed within this TTL.
+const defaultLeaseTTL int64 = 60
+
+// LockV3 is a reboot semaphore held by a single machine against an etcd v3
+// cluster. The held slot is attached to a lease kept alive for as long as
+// this process runs; if the process dies or the host reboots before calling
+// Unlock, the lease expires on its own and the slot is reclaimed without
+// needing unlockHeldLocks to run on a future restart.
+//
+// This per-holder expiry relies on all holders being stored in a single
+// JSON value at one key (see semaphore), with that key attached to whichever
+// holder's Txn wrote it last - so only one lease can ever be attached to the
+// key at a time. That is harmless while Max stays at its default of 1, but
+// it means LockV3 cannot correctly support Max>1: a second holder's
+// successful Txn would silently detach the first holder's lease, and that
+// first holder's slot would then only ever be reclaimed by unlockHeldLocks
+// polling, not by lease expiry. Lock refuses to proceed if it ever reads a
+// semaphore with Max>1 rather than silently providing weaker guarantees
+// than it advertises; supporting Max>1 would need one etcd key (and lease)
+// per holder instead of one shared key for all of them.
+type LockV3 struct {
+	id       string
+	ownerUID string
+	key      string
+	client   *etcd3.Client
+	leaseID  etcd3.LeaseID
+	// committed is set once leaseID has actually been attached to a written
+	// slot by a successful Txn, as opposed to merely granted by an earlier
+	// iteration of Lock's CAS loop and still unused. It distinguishes a
+	// lease that is live and backing this machine's held slot from one
+	// that is only ever pending and safe to revoke.
+	committed bool
+	cancel    context.CancelFunc
+}
+
+// NewV3 returns a Lock for the given machine-id backed by the given etcd v3
+// client. ownerUID identifies this locksmithd incarnation; see New.
+func NewV3(machineID, ownerUID string, client *etcd3.Client) *LockV3 {
+	return &LockV3{
+		id:       machineID,
+		ownerUID: ownerUID,
+		key:      defaultSemaphoreKey,
+		client:   client,
+	}
+}
+
+func (l *LockV3) get(ctx context.Context) (*semaphore, int64, error) {
+	resp, err := l.client.Get(ctx, l.key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return &semaphore{Max: defaultMax}, 0, nil
+	}
+
+	var sem semaphore
+	if err := json.Unmarshal(resp.Kvs[0].Value, &sem); err != nil {
+		return nil, 0, err
+	}
+
+	return &sem, resp.Kvs[0].ModRevision, nil
+}
+
+// Lock attempts to acquire a slot in the semaphore for this machine,
+// granting a lease and attaching the slot to it so that it is released
+// automatically if this process dies before calling Unlock. It returns
+// ErrExist if this machine already holds a slot.
+func (l *LockV3) Lock() error {
+	ctx := context.Background()
+
+	for {
+		sem, modRevision, err := l.get(ctx)
+		if err != nil {
+			return err
+		}
+
+		if sem.Max > 1 {
+			l.revokePendingLease(ctx)
+			return fmt.Errorf("lock: LockV3 only supports a single-holder semaphore (max=1), got max=%d", sem.Max)
+		}
+
+		if sem.held(l.id) {
+			l.revokePendingLease(ctx)
+			return ErrExist
+		}
+		if len(sem.Holders) >= sem.Max {
+			l.revokePendingLease(ctx)
+			return fmt.Errorf("lock: semaphore full (%d/%d)", len(sem.Holders), sem.Max)
+		}
+
+		// Grant the lease only once we know we are actually about to try
+		// to write a slot, and only the first time through this loop, so a
+		// lease is never left dangling on the ErrExist/full returns above.
+		if l.leaseID == 0 {
+			lease, err := l.client.Grant(ctx, defaultLeaseTTL)
+			if err != nil {
+				return fmt.Errorf("lock: error granting lease: %v", err)
+			}
+			l.leaseID = lease.ID
+		}
+
+		sem.Holders = append(sem.Holders, newHolder(l.id, l.ownerUID))
+		body, err := json.Marshal(sem)
+		if err != nil {
+			return err
+		}
+
+		txn, err := l.client.Txn(ctx).
+			If(etcd3.Compare(etcd3.ModRevision(l.key), "=", modRevision)).
+			Then(etcd3.OpPut(l.key, string(body), etcd3.WithLease(l.leaseID))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !txn.Succeeded {
+			continue
+		}
+
+		// leaseID is now attached to the live semaphore key: it backs a
+		// slot other machines can see, not a lease still waiting to be
+		// used. From here on it must never be revoked as if it were just
+		// a leftover from an earlier loop iteration.
+		l.committed = true
+
+		if err := l.startKeepalive(); err != nil {
+			// The slot was written but nothing will keep its lease alive,
+			// so leaving it in place would strand a slot that silently
+			// expires out from under a caller who still thinks Lock
+			// failed. Release it explicitly instead of letting the
+			// caller rediscover it via a later ErrExist.
+			if relErr := l.release(ctx); relErr != nil {
+				return fmt.Errorf("lock: error starting lease keepalive: %v (also failed to release the slot just written: %v)", err, relErr)
+			}
+			return err
+		}
+
+		return nil
+	}
+}
+
+// revokePendingLease revokes a lease granted by an earlier iteration of
+// Lock's CAS loop, if any, when a later iteration finds the slot is no
+// longer available. It logs rather than returns an error since it is only
+// ever called just before Lock itself returns a different error. It is a
+// no-op once the lease has been committed by a successful Txn: a committed
+// lease backs a live slot, not a pending grant, and revoking it would wipe
+// every holder out of the shared semaphore key.
+func (l *LockV3) revokePendingLease(ctx context.Context) {
+	if l.leaseID == 0 || l.committed {
+		return
+	}
+	l.client.Revoke(ctx, l.leaseID)
+	l.leaseID = 0
+}
+
+// startKeepalive begins refreshing this machine's lease until Unlock cancels
+// it, keeping the held slot alive for as long as this process runs.
+func (l *LockV3) startKeepalive() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+
+	ka, err := l.client.KeepAlive(ctx, l.leaseID)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("lock: error starting lease keepalive: %v", err)
+	}
+
+	go func() {
+		// Drain keepalive responses for as long as this process is up. We
+		// don't act on them; the lease simply expires on its own if we stop
+		// draining, which is what frees a slot left behind by a crash.
+		for range ka {
+		}
+	}()
+
+	return nil
+}
+
+// Unlock releases this machine's slot in the semaphore and stops refreshing
+// its lease. The lease itself is left to expire rather than being revoked
+// outright, so that a concurrent Lock which raced us for the same slot is
+// never disrupted.
+func (l *LockV3) Unlock() error {
+	if l.cancel != nil {
+		l.cancel()
+	}
+
+	return l.release(context.Background())
+}
+
+// release removes this machine's slot from the semaphore, retrying the CAS
+// until it succeeds, and clears the lease bookkeeping on the *LockV3 so it
+// is ready to be reused for another Lock call. It does not touch the
+// keepalive goroutine; callers that have one running must cancel it first.
+func (l *LockV3) release(ctx context.Context) error {
+	for {
+		sem, modRevision, err := l.get(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !sem.held(l.id) {
+			return ErrNotExist
+		}
+		sem.release(l.id)
+
+		body, err := json.Marshal(sem)
+		if err != nil {
+			return err
+		}
+
+		txn, err := l.client.Txn(ctx).
+			If(etcd3.Compare(etcd3.ModRevision(l.key), "=", modRevision)).
+			Then(etcd3.OpPut(l.key, string(body))).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !txn.Succeeded {
+			continue
+		}
+
+		l.leaseID = 0
+		l.committed = false
+
+		return nil
+	}
+}
+
+// ListV3 returns the current holders of the reboot semaphore in an etcd v3
+// cluster, for locksmithctl locks to print.
+func ListV3(client *etcd3.Client) ([]Holder, error) {
+	l := &LockV3{key: defaultSemaphoreKey, client: client}
+	sem, _, err := l.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return sem.Holders, nil
+}
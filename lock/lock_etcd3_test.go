@@ -0,0 +1,334 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	etcd3 "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/clientv3"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// fakeEtcd3KV is a single-key, in-memory stand-in for the clientv3.KV half
+// of an etcd v3 client, just enough of one to drive LockV3/AcquireDrainV3's
+// CAS-over-Txn loop without a live cluster. Like fakeKeysAPI in
+// lock_test.go, it only ever tracks one key at a time, so a given instance
+// must not be shared between a reboot-lock test and a drain-lock test.
+//
+// It deliberately never inspects the Cmp a Txn's If is given: the lock
+// package only ever builds one from the revision its own Get just
+// returned, so in a single-goroutine test the only way for a commit to go
+// stale is casFailures forcing it to, exactly as fakeKeysAPI.Set does for
+// the v2 CAS loop.
+type fakeEtcd3KV struct {
+	exists      bool
+	value       string
+	revision    int64
+	leaseID     etcd3.LeaseID
+	casFailures int
+}
+
+func (f *fakeEtcd3KV) Get(ctx context.Context, key string, opts ...etcd3.OpOption) (*etcd3.GetResponse, error) {
+	if !f.exists {
+		return &etcd3.GetResponse{}, nil
+	}
+	return &etcd3.GetResponse{Kvs: []*mvccpb.KeyValue{
+		{Value: []byte(f.value), ModRevision: f.revision},
+	}}, nil
+}
+
+func (f *fakeEtcd3KV) Put(ctx context.Context, key, val string, opts ...etcd3.OpOption) (*etcd3.PutResponse, error) {
+	f.exists = true
+	f.value = val
+	f.revision++
+	f.leaseID = 0
+	return &etcd3.PutResponse{}, nil
+}
+
+func (f *fakeEtcd3KV) Txn(ctx context.Context) etcd3.Txn {
+	return &fakeEtcd3Txn{kv: f}
+}
+
+func (f *fakeEtcd3KV) Delete(ctx context.Context, key string, opts ...etcd3.OpOption) (*etcd3.DeleteResponse, error) {
+	panic("fakeEtcd3KV: Delete not implemented")
+}
+
+func (f *fakeEtcd3KV) Compact(ctx context.Context, rev int64, opts ...etcd3.CompactOption) (*etcd3.CompactResponse, error) {
+	panic("fakeEtcd3KV: Compact not implemented")
+}
+
+func (f *fakeEtcd3KV) Do(ctx context.Context, op etcd3.Op) (etcd3.OpResponse, error) {
+	panic("fakeEtcd3KV: Do not implemented")
+}
+
+func (f *fakeEtcd3KV) semaphore(t *testing.T) semaphore {
+	t.Helper()
+	var sem semaphore
+	if !f.exists {
+		return sem
+	}
+	if err := json.Unmarshal([]byte(f.value), &sem); err != nil {
+		t.Fatalf("corrupt semaphore written: %v", err)
+	}
+	return sem
+}
+
+func (f *fakeEtcd3KV) drainSet(t *testing.T) drainSet {
+	t.Helper()
+	var d drainSet
+	if !f.exists {
+		return d
+	}
+	if err := json.Unmarshal([]byte(f.value), &d); err != nil {
+		t.Fatalf("corrupt drain set written: %v", err)
+	}
+	return d
+}
+
+// fakeEtcd3Txn only supports the one get-then-conditional-put shape the
+// lock package uses: a single comparison it never looks at, and a single
+// Put in Then that it applies if the commit is allowed to succeed.
+type fakeEtcd3Txn struct {
+	kv   *fakeEtcd3KV
+	then []etcd3.Op
+}
+
+func (t *fakeEtcd3Txn) If(cs ...etcd3.Cmp) etcd3.Txn {
+	return t
+}
+
+func (t *fakeEtcd3Txn) Then(ops ...etcd3.Op) etcd3.Txn {
+	t.then = ops
+	return t
+}
+
+func (t *fakeEtcd3Txn) Else(ops ...etcd3.Op) etcd3.Txn {
+	return t
+}
+
+func (t *fakeEtcd3Txn) Commit() (*etcd3.TxnResponse, error) {
+	if t.kv.casFailures > 0 {
+		t.kv.casFailures--
+		return &etcd3.TxnResponse{Succeeded: false}, nil
+	}
+
+	if len(t.then) != 1 || !t.then[0].IsPut() {
+		panic("fakeEtcd3Txn: only a single Put in Then is supported")
+	}
+	op := t.then[0]
+
+	t.kv.exists = true
+	t.kv.value = string(op.ValueBytes())
+	t.kv.revision++
+	t.kv.leaseID = op.LeaseID()
+
+	return &etcd3.TxnResponse{Succeeded: true}, nil
+}
+
+// fakeEtcd3Lease is a stand-in for the clientv3.Lease half of an etcd v3
+// client. Revoke mimics the one behavior LockV3 depends on: revoking a
+// lease deletes whichever key in kv is still attached to it, same as a
+// real etcd cluster would.
+type fakeEtcd3Lease struct {
+	kv            *fakeEtcd3KV
+	nextLeaseID   etcd3.LeaseID
+	failKeepAlive bool
+	revoked       map[etcd3.LeaseID]bool
+}
+
+func (l *fakeEtcd3Lease) Grant(ctx context.Context, ttl int64) (*etcd3.LeaseGrantResponse, error) {
+	l.nextLeaseID++
+	return &etcd3.LeaseGrantResponse{ID: l.nextLeaseID}, nil
+}
+
+func (l *fakeEtcd3Lease) Revoke(ctx context.Context, id etcd3.LeaseID) (*etcd3.LeaseRevokeResponse, error) {
+	if l.revoked == nil {
+		l.revoked = make(map[etcd3.LeaseID]bool)
+	}
+	l.revoked[id] = true
+
+	if l.kv.exists && l.kv.leaseID == id {
+		l.kv.exists = false
+		l.kv.value = ""
+		l.kv.revision++
+	}
+
+	return &etcd3.LeaseRevokeResponse{}, nil
+}
+
+func (l *fakeEtcd3Lease) KeepAlive(ctx context.Context, id etcd3.LeaseID) (<-chan *etcd3.LeaseKeepAliveResponse, error) {
+	if l.failKeepAlive {
+		return nil, fmt.Errorf("fakeEtcd3Lease: keepalive refused")
+	}
+	ch := make(chan *etcd3.LeaseKeepAliveResponse)
+	close(ch)
+	return ch, nil
+}
+
+func (l *fakeEtcd3Lease) KeepAliveOnce(ctx context.Context, id etcd3.LeaseID) (*etcd3.LeaseKeepAliveResponse, error) {
+	panic("fakeEtcd3Lease: KeepAliveOnce not implemented")
+}
+
+func (l *fakeEtcd3Lease) TimeToLive(ctx context.Context, id etcd3.LeaseID, opts ...etcd3.LeaseOption) (*etcd3.LeaseTimeToLiveResponse, error) {
+	panic("fakeEtcd3Lease: TimeToLive not implemented")
+}
+
+func (l *fakeEtcd3Lease) Leases(ctx context.Context) (*etcd3.LeaseLeasesResponse, error) {
+	panic("fakeEtcd3Lease: Leases not implemented")
+}
+
+func (l *fakeEtcd3Lease) Close() error {
+	return nil
+}
+
+func newFakeClient3() (*etcd3.Client, *fakeEtcd3KV, *fakeEtcd3Lease) {
+	kv := &fakeEtcd3KV{}
+	lease := &fakeEtcd3Lease{kv: kv}
+	return &etcd3.Client{KV: kv, Lease: lease}, kv, lease
+}
+
+func TestLockV3AcquiresSlot(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+	l := NewV3("machine-a", "owner-1", client)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock() = %v, want nil", err)
+	}
+	if !kv.semaphore(t).held("machine-a") {
+		t.Error("expected machine-a to hold a slot after Lock")
+	}
+	if kv.leaseID == 0 {
+		t.Error("expected the written slot to be attached to a lease")
+	}
+}
+
+func TestLockV3ReturnsErrExistIfAlreadyHeld(t *testing.T) {
+	client, _, _ := newFakeClient3()
+	l := NewV3("machine-a", "owner-1", client)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("first Lock() = %v, want nil", err)
+	}
+	if err := l.Lock(); err != ErrExist {
+		t.Errorf("second Lock() = %v, want ErrExist", err)
+	}
+}
+
+func TestLockV3RetryAfterSuccessDoesNotRevokeCommittedLease(t *testing.T) {
+	client, kv, lease := newFakeClient3()
+	l := NewV3("machine-a", "owner-1", client)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("first Lock() = %v, want nil", err)
+	}
+	committed := kv.leaseID
+
+	if err := l.Lock(); err != ErrExist {
+		t.Fatalf("second Lock() = %v, want ErrExist", err)
+	}
+
+	if lease.revoked[committed] {
+		t.Error("retrying Lock on an already-committed slot must not revoke its live lease")
+	}
+	if !kv.semaphore(t).held("machine-a") {
+		t.Error("the committed slot must still be held after a retried Lock call")
+	}
+}
+
+func TestLockV3RejectsMaxGreaterThanOne(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+	body, err := json.Marshal(semaphore{Max: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.exists = true
+	kv.value = string(body)
+	kv.revision = 1
+
+	l := NewV3("machine-a", "owner-1", client)
+	if err := l.Lock(); err == nil {
+		t.Error("expected Lock() to refuse a semaphore with Max>1")
+	}
+}
+
+func TestLockV3RetriesOnCASFailure(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+	kv.casFailures = 2
+
+	l := NewV3("machine-a", "owner-1", client)
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock() = %v, want nil after retrying past CAS failures", err)
+	}
+	if !kv.semaphore(t).held("machine-a") {
+		t.Error("expected machine-a to hold a slot once Lock stopped retrying")
+	}
+}
+
+func TestLockV3ReleasesSlotIfKeepaliveFails(t *testing.T) {
+	client, kv, lease := newFakeClient3()
+	lease.failKeepAlive = true
+
+	l := NewV3("machine-a", "owner-1", client)
+	if err := l.Lock(); err == nil {
+		t.Fatal("expected Lock() to fail when startKeepalive fails")
+	}
+	if kv.semaphore(t).held("machine-a") {
+		t.Error("expected the slot written just before the keepalive failure to be released")
+	}
+}
+
+func TestLockV3UnlockReleasesSlot(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+	l := NewV3("machine-a", "owner-1", client)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock() = %v, want nil", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v, want nil", err)
+	}
+	if kv.semaphore(t).held("machine-a") {
+		t.Error("expected machine-a's slot to be released after Unlock")
+	}
+}
+
+func TestLockV3UnlockReturnsErrNotExistIfNotHeld(t *testing.T) {
+	client, _, _ := newFakeClient3()
+	l := NewV3("machine-a", "owner-1", client)
+
+	if err := l.Unlock(); err != ErrNotExist {
+		t.Errorf("Unlock() = %v, want ErrNotExist", err)
+	}
+}
+
+func TestLockV3UnlockRetriesOnCASFailure(t *testing.T) {
+	client, kv, _ := newFakeClient3()
+	l := NewV3("machine-a", "owner-1", client)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock() = %v, want nil", err)
+	}
+
+	kv.casFailures = 2
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v, want nil after retrying past CAS failures", err)
+	}
+	if kv.semaphore(t).held("machine-a") {
+		t.Error("expected machine-a's slot to be released once Unlock stopped retrying")
+	}
+}
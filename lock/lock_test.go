@@ -0,0 +1,188 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"encoding/json"
+	"testing"
+
+	etcd "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// fakeKeysAPI is a single-key, in-memory stand-in for etcd.KeysAPI, just
+// enough of one to drive Lock/Unlock/AcquireDrain/ReleaseDrain's CAS loop
+// without a live etcd cluster. casFailures lets a test simulate another
+// writer racing in between a Get and the Set that follows it: the next
+// that many Sets fail with ErrorCodeTestFailed before succeeding normally.
+type fakeKeysAPI struct {
+	exists      bool
+	value       string
+	index       uint64
+	casFailures int
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	if !f.exists {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	return &etcd.Response{Node: &etcd.Node{Value: f.value, ModifiedIndex: f.index}}, nil
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	if f.casFailures > 0 {
+		f.casFailures--
+		return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed}
+	}
+	if opts != nil {
+		if opts.PrevExist == etcd.PrevNoExist && f.exists {
+			return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed}
+		}
+		if opts.PrevIndex != 0 && opts.PrevIndex != f.index {
+			return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed}
+		}
+	}
+
+	f.exists = true
+	f.value = value
+	f.index++
+
+	return &etcd.Response{Node: &etcd.Node{Value: value, ModifiedIndex: f.index}}, nil
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	panic("fakeKeysAPI: Delete not implemented")
+}
+
+func (f *fakeKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	panic("fakeKeysAPI: Create not implemented")
+}
+
+func (f *fakeKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	panic("fakeKeysAPI: CreateInOrder not implemented")
+}
+
+func (f *fakeKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	panic("fakeKeysAPI: Update not implemented")
+}
+
+func (f *fakeKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	panic("fakeKeysAPI: Watcher not implemented")
+}
+
+func (f *fakeKeysAPI) semaphore(t *testing.T) semaphore {
+	t.Helper()
+	var sem semaphore
+	if !f.exists {
+		return sem
+	}
+	if err := json.Unmarshal([]byte(f.value), &sem); err != nil {
+		t.Fatalf("corrupt semaphore written: %v", err)
+	}
+	return sem
+}
+
+func TestLockAcquiresSlot(t *testing.T) {
+	ec := &fakeKeysAPI{}
+	l := New("machine-a", "owner-1", ec)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock() = %v, want nil", err)
+	}
+
+	sem := ec.semaphore(t)
+	if !sem.held("machine-a") {
+		t.Error("expected machine-a to hold a slot after Lock")
+	}
+}
+
+func TestLockReturnsErrExistIfAlreadyHeld(t *testing.T) {
+	ec := &fakeKeysAPI{}
+	l := New("machine-a", "owner-1", ec)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("first Lock() = %v, want nil", err)
+	}
+	if err := l.Lock(); err != ErrExist {
+		t.Errorf("second Lock() = %v, want ErrExist", err)
+	}
+}
+
+func TestLockReturnsErrorWhenFull(t *testing.T) {
+	sem := semaphore{Max: 1, Holders: []Holder{newHolder("machine-a", "owner-1")}}
+	body, err := json.Marshal(sem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := &fakeKeysAPI{exists: true, value: string(body), index: 1}
+
+	l := New("machine-b", "owner-2", ec)
+	if err := l.Lock(); err == nil {
+		t.Error("expected Lock() to fail against a full semaphore")
+	}
+}
+
+func TestLockRetriesOnCASFailure(t *testing.T) {
+	ec := &fakeKeysAPI{casFailures: 2}
+	l := New("machine-a", "owner-1", ec)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock() = %v, want nil after retrying past CAS failures", err)
+	}
+	if !ec.semaphore(t).held("machine-a") {
+		t.Error("expected machine-a to hold a slot once Lock stopped retrying")
+	}
+}
+
+func TestUnlockReleasesSlot(t *testing.T) {
+	ec := &fakeKeysAPI{}
+	l := New("machine-a", "owner-1", ec)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock() = %v, want nil", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v, want nil", err)
+	}
+	if ec.semaphore(t).held("machine-a") {
+		t.Error("expected machine-a's slot to be released after Unlock")
+	}
+}
+
+func TestUnlockReturnsErrNotExistIfNotHeld(t *testing.T) {
+	ec := &fakeKeysAPI{}
+	l := New("machine-a", "owner-1", ec)
+
+	if err := l.Unlock(); err != ErrNotExist {
+		t.Errorf("Unlock() = %v, want ErrNotExist", err)
+	}
+}
+
+func TestUnlockRetriesOnCASFailure(t *testing.T) {
+	ec := &fakeKeysAPI{}
+	l := New("machine-a", "owner-1", ec)
+
+	if err := l.Lock(); err != nil {
+		t.Fatalf("Lock() = %v, want nil", err)
+	}
+
+	ec.casFailures = 2
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v, want nil after retrying past CAS failures", err)
+	}
+	if ec.semaphore(t).held("machine-a") {
+		t.Error("expected machine-a's slot to be released once Unlock stopped retrying")
+	}
+}
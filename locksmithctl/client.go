@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	etcd "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/client"
+	etcd3 "github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/etcd/clientv3"
+)
+
+const (
+	etcdAPIv2 = "v2"
+	etcdAPIv3 = "v3"
+)
+
+// etcdClient bundles the etcd v2 and v3 clients getClient can build; exactly
+// one of v2 or v3 is set, depending on which API LOCKSMITHD_ETCD_API asked
+// for.
+type etcdClient struct {
+	v2 etcd.KeysAPI
+	v3 *etcd3.Client
+}
+
+// getClient builds the etcd client locksmithd locks against. The API
+// version is selected with the LOCKSMITHD_ETCD_API environment variable
+// ("v2", the default, or "v3"); v3 backs the lease-based lock.LockV3 instead
+// of lock.Lock, so a crashed locksmithd no longer strands its reboot slot
+// until unlockHeldLocks next runs.
+func getClient() (*etcdClient, error) {
+	api := strings.ToLower(os.Getenv("LOCKSMITHD_ETCD_API"))
+	if api == "" {
+		api = etcdAPIv2
+	}
+
+	endpoints := etcdEndpoints()
+
+	switch api {
+	case etcdAPIv2:
+		c, err := etcd.New(etcd.Config{Endpoints: endpoints})
+		if err != nil {
+			return nil, err
+		}
+		return &etcdClient{v2: etcd.NewKeysAPI(c)}, nil
+	case etcdAPIv3:
+		c, err := etcd3.New(etcd3.Config{Endpoints: endpoints})
+		if err != nil {
+			return nil, err
+		}
+		return &etcdClient{v3: c}, nil
+	default:
+		return nil, fmt.Errorf("unknown LOCKSMITHD_ETCD_API %q, must be %q or %q", api, etcdAPIv2, etcdAPIv3)
+	}
+}
+
+// etcdEndpoints returns the etcd endpoints to dial, following the same
+// ETCDCTL_ENDPOINTS convention as etcdctl so locksmithd needs no separate
+// configuration on a host already set up to talk to its etcd cluster.
+func etcdEndpoints() []string {
+	if eps := os.Getenv("ETCDCTL_ENDPOINTS"); eps != "" {
+		return strings.Split(eps, ",")
+	}
+	return []string{"http://127.0.0.1:2379", "http://127.0.0.1:4001"}
+}
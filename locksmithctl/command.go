@@ -0,0 +1,34 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "flag"
+
+// Command is a single locksmithctl subcommand.
+type Command struct {
+	Name    string                  // Name of the command, e.g. "locks"
+	Summary string                  // One-line description of what the command does
+	Usage   string                  // Usage options/arguments, e.g. "[--stale]"
+	Run     func(args []string) int // Run a command with the given arguments, return exit status
+
+	Flags flag.FlagSet // Set of flags associated with this command
+}
+
+// commands lists all registered locksmithctl subcommands, keyed by name.
+var commands = map[string]*Command{}
+
+func register(c *Command) {
+	commands[c.Name] = c
+}
@@ -29,6 +29,7 @@ import (
 
 	"github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/go-systemd/dbus"
 	"github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/go-systemd/login1"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
 
 	"github.com/coreos/locksmith/lock"
 	"github.com/coreos/locksmith/pkg/machineid"
@@ -96,26 +97,48 @@ func expBackoff(interval time.Duration) time.Duration {
 	return interval
 }
 
-func rebootAndSleep(lgn *login1.Conn) {
-	// Broadcast a notice, if broadcast found lines to notify, delay the reboot.
-	delaymins := loginsRebootDelay / time.Minute
-	lines := broadcast(fmt.Sprintf("System reboot in %d minutes!", delaymins))
-	if 0 != lines {
-		fmt.Printf("Logins detected, delaying reboot for %d minutes.\n", delaymins)
-		time.Sleep(loginsRebootDelay)
+// rebootAndSleep consults notifiers before rebooting, so that e.g. logged
+// in users or a webhook can postpone or veto the reboot. It returns whether
+// the reboot actually happened: if it did, it reboots and sleeps, giving
+// the reboot a very long time to occur before this function would
+// otherwise return; if a notifier cancelled it, it returns false right
+// away so the caller can release the reboot lock and retry later instead
+// of mistaking the cancellation for a completed reboot.
+func rebootAndSleep(lgn *login1.Conn, notifiers []Notifier) bool {
+	if !preReboot(context.Background(), notifiers, loginsRebootDelay) {
+		fmt.Println("Reboot cancelled by a notifier.")
+		return false
 	}
+
 	lgn.Reboot(false)
 	fmt.Println("Reboot sent. Going to sleep.")
 
 	// Wait a really long time for the reboot to occur.
 	time.Sleep(time.Hour * 24 * 7)
+	return true
 }
 
 // lockAndReboot attempts to acquire the lock and reboot the machine in an
 // infinite loop. Returns if the reboot failed.
-func (r rebooter) lockAndReboot(lck *lock.Lock) {
+func (r rebooter) lockAndReboot(lck lock.Locker) {
 	interval := initialInterval
 	for {
+		if dc, ok := lck.(lock.DrainChecker); ok {
+			active, err := dc.DrainActive()
+			if err != nil {
+				interval = expBackoff(interval)
+				fmt.Printf("Retrying in %v. Error checking drain locks: %v\n", interval, err)
+				time.Sleep(interval)
+				continue
+			}
+			if active {
+				interval = expBackoff(interval)
+				fmt.Printf("Shared drain lock held, retrying reboot lock in %v.\n", interval)
+				time.Sleep(interval)
+				continue
+			}
+		}
+
 		err := lck.Lock()
 		if err != nil && err != lock.ErrExist {
 			interval = expBackoff(interval)
@@ -125,14 +148,28 @@ func (r rebooter) lockAndReboot(lck *lock.Lock) {
 			continue
 		}
 
-		rebootAndSleep(r.lgn)
+		if rebootAndSleep(r.lgn, r.notifiers) {
+			return
+		}
 
-		return
+		// A notifier cancelled the reboot: release the slot we just
+		// acquired rather than stranding it, and back off before retrying
+		// so we don't hammer a notifier that is still objecting.
+		if unlockErr := lck.Unlock(); unlockErr != nil {
+			fmt.Printf("Error releasing lock after cancelled reboot: %v\n", unlockErr)
+		}
+
+		interval = expBackoff(interval)
+		fmt.Printf("Retrying in %v.\n", interval)
+		time.Sleep(interval)
 	}
 }
 
-func setupLock() (lck *lock.Lock, err error) {
-	elc, err := getClient()
+// setupLock builds the reboot lock for this machine, tagging the slot it
+// will acquire with ownerUID so a later locksmithctl locks --stale can tell
+// whether this incarnation of locksmithd is still the one holding it.
+func setupLock(ownerUID string) (lck lock.Locker, err error) {
+	ec, err := getClient()
 	if err != nil {
 		return nil, fmt.Errorf("Error initializing etcd client: %v", err)
 	}
@@ -142,11 +179,50 @@ func setupLock() (lck *lock.Lock, err error) {
 		return nil, fmt.Errorf("Cannot read machine-id")
 	}
 
-	lck = lock.New(mID, elc)
+	if ec.v3 != nil {
+		lck = lock.NewV3(mID, ownerUID, ec.v3)
+	} else {
+		lck = lock.New(mID, ownerUID, ec.v2)
+	}
 
 	return lck, nil
 }
 
+// startHeartbeat periodically republishes ownerUID as the liveness
+// heartbeat for machineID until stop is closed, so locksmithctl locks
+// --stale can distinguish a slot held by this running daemon from one left
+// behind by a crashed previous incarnation.
+func startHeartbeat(machineID, ownerUID string, stop <-chan struct{}) {
+	refresh := func() error {
+		ec, err := getClient()
+		if err != nil {
+			return err
+		}
+		if ec.v3 != nil {
+			return lock.RefreshHeartbeatV3(ec.v3, machineID, ownerUID)
+		}
+		return lock.RefreshHeartbeat(ec.v2, machineID, ownerUID)
+	}
+
+	if err := refresh(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error publishing heartbeat: %v\n", err)
+	}
+
+	ticker := time.NewTicker(time.Duration(lock.HeartbeatTTL/2) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := refresh(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error publishing heartbeat: %v\n", err)
+			}
+		}
+	}
+}
+
 // etcdActive returns true if etcd is not in an inactive state according to systemd.
 func etcdActive() (active bool, name string, err error) {
 	active = false
@@ -178,8 +254,10 @@ func etcdActive() (active bool, name string, err error) {
 }
 
 type rebooter struct {
-	strategy string
-	lgn      *login1.Conn
+	strategy  string
+	lgn       *login1.Conn
+	ownerUID  string
+	notifiers []Notifier
 }
 
 func (r rebooter) useLock() (useLock bool, err error) {
@@ -215,7 +293,7 @@ func (r rebooter) reboot() int {
 	}
 
 	if useLock {
-		lck, err := setupLock()
+		lck, err := setupLock(r.ownerUID)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			return 1
@@ -230,13 +308,13 @@ func (r rebooter) reboot() int {
 		r.lockAndReboot(lck)
 	}
 
-	rebootAndSleep(r.lgn)
+	rebootAndSleep(r.lgn, r.notifiers)
 	fmt.Println("Error: reboot attempt never finished")
 	return 1
 }
 
 // unlockIfHeld will unlock a lock, if it is held by this machine, or return an error.
-func unlockIfHeld(lck *lock.Lock) error {
+func unlockIfHeld(lck lock.Locker) error {
 	err := lck.Unlock()
 	if err == lock.ErrNotExist {
 		return nil
@@ -250,7 +328,7 @@ func unlockIfHeld(lck *lock.Lock) error {
 
 // unlockHeldLock will loop until it can confirm that any held locks are
 // released or a stop signal is sent.
-func unlockHeldLocks(stop chan struct{}, wg *sync.WaitGroup) {
+func unlockHeldLocks(stop chan struct{}, wg *sync.WaitGroup, ownerUID string) {
 	defer wg.Done()
 	interval := initialInterval
 	for {
@@ -272,7 +350,7 @@ func unlockHeldLocks(stop chan struct{}, wg *sync.WaitGroup) {
 				}
 			}
 
-			lck, err := setupLock()
+			lck, err := setupLock(ownerUID)
 			if err != nil {
 				reason = "error setting up lock: " + err.Error()
 				break
@@ -346,16 +424,31 @@ func runDaemon() int {
 		return 1
 	}
 
+	// The heartbeat needs to keep running through reboot() below, well after
+	// stop is closed, so it gets its own channel; it only ever stops via
+	// process exit.
+	ownerUID := lock.NewOwnerUID()
+	hbStop := make(chan struct{})
+	if mID := machineid.MachineID("/"); mID != "" {
+		go startHeartbeat(mID, ownerUID, hbStop)
+	}
+
 	var wg sync.WaitGroup
 	if strategy != StrategyReboot {
 		wg.Add(1)
-		go unlockHeldLocks(stop, &wg)
+		go unlockHeldLocks(stop, &wg, ownerUID)
 	}
 
 	ch := make(chan updateengine.Status, 1)
 	go ue.RebootNeededSignal(ch, stop)
 
-	r := rebooter{strategy, lgn}
+	notifiers, err := buildNotifiers(lgn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error configuring reboot notifiers:", err)
+		return 1
+	}
+
+	r := rebooter{strategy, lgn, ownerUID, notifiers}
 
 	result, err := ue.GetStatus()
 	if err != nil {
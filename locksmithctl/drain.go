@@ -0,0 +1,107 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+var cmdDrainLock = &Command{
+	Name:    "drain-lock",
+	Summary: "Take a shared drain lock, blocking reboots cluster-wide",
+	Usage:   "<name>",
+	Run:     runDrainLock,
+}
+
+var cmdDrainUnlock = &Command{
+	Name:    "drain-unlock",
+	Summary: "Release a shared drain lock taken with drain-lock",
+	Usage:   "<name>",
+	Run:     runDrainUnlock,
+}
+
+func init() {
+	register(cmdDrainLock)
+	register(cmdDrainUnlock)
+}
+
+func runDrainLock(args []string) int {
+	name, ok := drainLockName(args)
+	if !ok {
+		return 2
+	}
+
+	ec, err := getClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+
+	if ec.v3 != nil {
+		err = lock.AcquireDrainV3(ec.v3, name)
+	} else {
+		err = lock.AcquireDrain(ec.v2, name)
+	}
+	if err == lock.ErrDrainExist {
+		fmt.Fprintf(os.Stderr, "Drain lock %q is already held\n", name)
+		return 1
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Error taking drain lock:", err)
+		return 1
+	}
+
+	fmt.Printf("Took drain lock %q\n", name)
+	return 0
+}
+
+func runDrainUnlock(args []string) int {
+	name, ok := drainLockName(args)
+	if !ok {
+		return 2
+	}
+
+	ec, err := getClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+
+	if ec.v3 != nil {
+		err = lock.ReleaseDrainV3(ec.v3, name)
+	} else {
+		err = lock.ReleaseDrain(ec.v2, name)
+	}
+	if err == lock.ErrDrainNotExist {
+		fmt.Fprintf(os.Stderr, "Drain lock %q is not held\n", name)
+		return 1
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Error releasing drain lock:", err)
+		return 1
+	}
+
+	fmt.Printf("Released drain lock %q\n", name)
+	return 0
+}
+
+func drainLockName(args []string) (string, bool) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: locksmithctl drain-lock|drain-unlock <name>")
+		return "", false
+	}
+	return args[0], true
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+var (
+	cmdLocks = &Command{
+		Name:    "locks",
+		Summary: "List the current holders of the reboot lock",
+		Usage:   "[--stale]",
+		Run:     runLocks,
+	}
+	locksStale bool
+)
+
+func init() {
+	cmdLocks.Flags.BoolVar(&locksStale, "stale", false, "only print holders whose heartbeat no longer matches a live locksmithd")
+	register(cmdLocks)
+}
+
+// runLocks prints the current reboot-lock holders, one per line, along with
+// enough detail about the locksmithd which acquired each slot to diagnose a
+// stuck reboot lock without logging into the holding machine.
+func runLocks(args []string) int {
+	ec, err := getClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error initializing etcd client:", err)
+		return 1
+	}
+
+	var holders []lock.Holder
+	if ec.v3 != nil {
+		holders, err = lock.ListV3(ec.v3)
+	} else {
+		holders, err = lock.List(ec.v2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listing lock holders:", err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MACHINE\tHOSTNAME\tPID\tKERNEL\tOS\tAGE\tSTALE")
+
+	for _, h := range holders {
+		isStale, err := holderStale(ec, h)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error checking heartbeat:", err)
+			return 1
+		}
+		if locksStale && !isStale {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%t\n",
+			h.MachineID, h.Hostname, h.PID, h.KernelVersion, h.OSVersion,
+			time.Since(h.AcquiredAt).Round(time.Second), isStale,
+		)
+	}
+
+	w.Flush()
+
+	drainHolders, err := listDrain(ec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listing drain locks:", err)
+		return 1
+	}
+	if !locksStale && len(drainHolders) > 0 {
+		fmt.Println("\nShared drain locks:")
+		for _, d := range drainHolders {
+			fmt.Printf("  %s (held for %s)\n", d.Name, time.Since(d.AcquiredAt).Round(time.Second))
+		}
+	}
+
+	return 0
+}
+
+func listDrain(ec *etcdClient) ([]lock.DrainHolder, error) {
+	if ec.v3 != nil {
+		return lock.ListDrainV3(ec.v3)
+	}
+	return lock.ListDrain(ec.v2)
+}
+
+// holderStale reports whether h's OwnerUID no longer matches the heartbeat
+// currently published for its machine-id, meaning the locksmithd which
+// acquired this slot is not the one (if any) running there now.
+func holderStale(ec *etcdClient, h lock.Holder) (bool, error) {
+	var current string
+	var err error
+
+	if ec.v3 != nil {
+		current, err = lock.GetHeartbeatV3(ec.v3, h.MachineID)
+	} else {
+		current, err = lock.GetHeartbeat(ec.v2, h.MachineID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return isStaleHolder(current, h), nil
+}
+
+// isStaleHolder is the pure comparison at the heart of holderStale, pulled
+// out so it can be tested without a live or fake etcd client: a holder is
+// stale if no heartbeat is currently published for its machine, or if the
+// published heartbeat belongs to a different locksmithd incarnation than
+// the one that acquired this slot.
+func isStaleHolder(currentOwnerUID string, h lock.Holder) bool {
+	return currentOwnerUID == "" || currentOwnerUID != h.OwnerUID
+}
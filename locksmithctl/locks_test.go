@@ -0,0 +1,45 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/coreos/locksmith/lock"
+)
+
+func TestIsStaleHolderNoHeartbeat(t *testing.T) {
+	h := lock.Holder{MachineID: "abc", OwnerUID: "owner-1"}
+
+	if !isStaleHolder("", h) {
+		t.Error("a holder with no published heartbeat should be stale")
+	}
+}
+
+func TestIsStaleHolderMismatchedOwner(t *testing.T) {
+	h := lock.Holder{MachineID: "abc", OwnerUID: "owner-1"}
+
+	if !isStaleHolder("owner-2", h) {
+		t.Error("a holder whose heartbeat belongs to a different incarnation should be stale")
+	}
+}
+
+func TestIsStaleHolderCurrent(t *testing.T) {
+	h := lock.Holder{MachineID: "abc", OwnerUID: "owner-1"}
+
+	if isStaleHolder("owner-1", h) {
+		t.Error("a holder whose heartbeat matches its OwnerUID should not be stale")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	if filepath.Base(os.Args[0]) == "locksmithd" {
+		if hasMonitorFlag(os.Args[1:]) {
+			os.Exit(runMonitor())
+		}
+		os.Exit(runDaemon())
+	}
+
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: locksmithctl <command> [arguments]")
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "locksmithctl: unknown command %q\n", name)
+		os.Exit(2)
+	}
+
+	cmd.Flags.Parse(os.Args[2:])
+	os.Exit(cmd.Run(cmd.Flags.Args()))
+}
+
+// hasMonitorFlag reports whether -monitor (or --monitor) is among
+// locksmithd's arguments, requesting that it run under the supervisor in
+// monitor.go instead of directly.
+func hasMonitorFlag(args []string) bool {
+	for _, a := range args {
+		if a == "-monitor" || a == "--monitor" {
+			return true
+		}
+	}
+	return false
+}
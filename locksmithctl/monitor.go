@@ -0,0 +1,153 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxCrashLogs bounds how many past crashes monitorStatus remembers, so a
+// node stuck in a long restart loop doesn't grow its status page forever.
+const maxCrashLogs = 10
+
+// crashLog records one unexpected exit of the supervised locksmithd child,
+// for operators to inspect on the monitor's status endpoint.
+type crashLog struct {
+	Time   time.Time
+	Err    string
+	Output string
+}
+
+// monitor supervises a locksmithd child process, restarting it with
+// exponential backoff on any exit other than a clean 0 (e.g. a node
+// running REBOOT_STRATEGY=off). A crashed locksmithd on a node holding the
+// etcd reboot lock would otherwise strand the whole cluster until
+// unlockHeldLocks gets a chance to run on some future restart; re-execing
+// it here means that happens within seconds instead.
+type monitor struct {
+	mu    sync.Mutex
+	crash []crashLog
+}
+
+// runMonitor re-execs this binary as a locksmithd child, in a loop,
+// forwarding SIGTERM/SIGINT to it and restarting it with backoff if it
+// exits non-zero or is killed by a signal.
+func runMonitor() int {
+	m := &monitor{}
+	go m.serveStatus()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+
+	interval := initialInterval
+	args := monitoredArgs()
+
+	for {
+		cmd := exec.Command(os.Args[0], args...)
+
+		var output bytes.Buffer
+		cmd.Stdout = io.MultiWriter(os.Stdout, &output)
+		cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, "monitor: error starting locksmithd:", err)
+			return 1
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		select {
+		case sig := <-shutdown:
+			fmt.Fprintln(os.Stderr, "monitor: forwarding", sig, "to locksmithd")
+			cmd.Process.Signal(sig)
+			<-done
+			return 0
+		case err := <-done:
+			if err == nil {
+				fmt.Fprintln(os.Stderr, "monitor: locksmithd exited cleanly, not restarting")
+				return 0
+			}
+
+			m.recordCrash(output.String(), err)
+			interval = expBackoff(interval)
+			fmt.Fprintf(os.Stderr, "monitor: locksmithd exited: %v, restarting in %v\n", err, interval)
+			time.Sleep(interval)
+		}
+	}
+}
+
+// monitoredArgs returns the arguments the locksmithd child should be
+// re-exec'd with: the monitor's own arguments, minus the -monitor flag that
+// would otherwise have it supervise itself.
+func monitoredArgs() []string {
+	args := make([]string, 0, len(os.Args)-1)
+	for _, a := range os.Args[1:] {
+		if a == "-monitor" || a == "--monitor" {
+			continue
+		}
+		args = append(args, a)
+	}
+	return args
+}
+
+func (m *monitor) recordCrash(output string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.crash = append(m.crash, crashLog{Time: time.Now(), Err: err.Error(), Output: output})
+	if len(m.crash) > maxCrashLogs {
+		m.crash = m.crash[len(m.crash)-maxCrashLogs:]
+	}
+}
+
+// serveStatus exposes the last few crash logs over HTTP so operators can
+// tell why reboot coordination stopped without needing a shell on the node.
+func (m *monitor) serveStatus() {
+	addr := os.Getenv("LOCKSMITHD_MONITOR_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:7988"
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "monitor: error starting status endpoint:", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", m.handleStatus)
+	http.Serve(ln, mux)
+}
+
+func (m *monitor) handleStatus(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "locksmithd-monitor: %d recent crash(es)\n", len(m.crash))
+	for _, c := range m.crash {
+		fmt.Fprintf(w, "\n=== %s ===\nexit: %s\n%s\n", c.Time.Format(time.RFC3339), c.Err, c.Output)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMonitoredArgsStripsMonitorFlag(t *testing.T) {
+	defer func(orig []string) { os.Args = orig }(os.Args)
+
+	os.Args = []string{"locksmithd", "-monitor", "-reboot-strategy=etcd-lock"}
+	got := monitoredArgs()
+	want := []string{"-reboot-strategy=etcd-lock"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("monitoredArgs() = %v, want %v", got, want)
+	}
+}
+
+func TestMonitoredArgsStripsLongMonitorFlag(t *testing.T) {
+	defer func(orig []string) { os.Args = orig }(os.Args)
+
+	os.Args = []string{"locksmithd", "--monitor"}
+	got := monitoredArgs()
+	if len(got) != 0 {
+		t.Errorf("monitoredArgs() = %v, want empty", got)
+	}
+}
+
+func TestMonitoredArgsPreservesOtherFlags(t *testing.T) {
+	defer func(orig []string) { os.Args = orig }(os.Args)
+
+	os.Args = []string{"locksmithd", "-endpoint=http://127.0.0.1:2379"}
+	got := monitoredArgs()
+	want := []string{"-endpoint=http://127.0.0.1:2379"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("monitoredArgs() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/locksmith/Godeps/_workspace/src/github.com/coreos/go-systemd/login1"
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
+
+	"github.com/coreos/locksmith/pkg/machineid"
+	"github.com/coreos/locksmith/updateengine"
+)
+
+// Notifier is consulted, in order, before locksmithd reboots a machine. Any
+// notifier may postpone or veto the reboot; if one vetoes it, Cancelled is
+// called on it and every notifier consulted before it, so each can clean up
+// or let waiting sessions know why nothing happened.
+type Notifier interface {
+	// PreReboot is given the currently planned delay before the reboot
+	// proceeds. It returns whether the reboot should proceed; a notifier
+	// that wants to postpone rather than veto outright should sleep for as
+	// long as it wants before returning true.
+	PreReboot(ctx context.Context, delay time.Duration) (proceed bool, err error)
+
+	// Cancelled is called if this notifier, or one consulted after it, is
+	// the reason the reboot did not happen.
+	Cancelled(reason string)
+}
+
+// buildNotifiers parses REBOOT_NOTIFIERS (a comma-separated list, default
+// "utmp") into the Notifier chain rebooter.reboot consults.
+func buildNotifiers(lgn *login1.Conn) ([]Notifier, error) {
+	names := os.Getenv("REBOOT_NOTIFIERS")
+	if names == "" {
+		names = "utmp"
+	}
+
+	var notifiers []Notifier
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "utmp":
+			notifiers = append(notifiers, utmpNotifier{})
+		case "webhook":
+			url := os.Getenv("REBOOT_WEBHOOK_URL")
+			if url == "" {
+				return nil, fmt.Errorf("REBOOT_NOTIFIERS includes webhook but REBOOT_WEBHOOK_URL is not set")
+			}
+			notifiers = append(notifiers, &webhookNotifier{url: url})
+		case "systemd-inhibit":
+			notifiers = append(notifiers, &systemdInhibitNotifier{lgn: lgn})
+		default:
+			return nil, fmt.Errorf("unknown reboot notifier %q", name)
+		}
+	}
+
+	return notifiers, nil
+}
+
+// preReboot consults notifiers in order, stopping and notifying every
+// notifier consulted so far of the cancellation as soon as one of them
+// vetoes the reboot.
+func preReboot(ctx context.Context, notifiers []Notifier, delay time.Duration) bool {
+	for i, n := range notifiers {
+		proceed, err := n.PreReboot(ctx, delay)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reboot notifier error: %v\n", err)
+		}
+		if !proceed {
+			reason := "a reboot notifier cancelled the reboot"
+			if err != nil {
+				reason = err.Error()
+			}
+			for _, cancelled := range notifiers[:i+1] {
+				cancelled.Cancelled(reason)
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// utmpNotifier is the original broadcast-to-logged-in-users notifier,
+// refactored out of rebootAndSleep.
+type utmpNotifier struct{}
+
+func (utmpNotifier) PreReboot(ctx context.Context, delay time.Duration) (bool, error) {
+	delaymins := delay / time.Minute
+	lines := broadcast(fmt.Sprintf("System reboot in %d minutes!", delaymins))
+	if lines != 0 {
+		fmt.Printf("Logins detected, delaying reboot for %d minutes.\n", delaymins)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+
+	return true, nil
+}
+
+func (utmpNotifier) Cancelled(reason string) {
+	broadcast(fmt.Sprintf("Reboot cancelled: %s", reason))
+}
+
+// webhookNotifier POSTs a JSON payload describing the planned reboot to a
+// configurable URL, and honors a 2xx response carrying {"delay":"15m"} by
+// postponing that long before letting the reboot proceed.
+type webhookNotifier struct {
+	url string
+}
+
+type webhookPayload struct {
+	MachineID      string    `json:"machineID"`
+	Hostname       string    `json:"hostname"`
+	PlannedReboot  time.Time `json:"plannedReboot"`
+	CurrentVersion string    `json:"currentVersion"`
+}
+
+type webhookResponse struct {
+	Delay string `json:"delay"`
+}
+
+func (n *webhookNotifier) PreReboot(ctx context.Context, delay time.Duration) (bool, error) {
+	payload := webhookPayload{
+		MachineID:     machineid.MachineID("/"),
+		PlannedReboot: time.Now().Add(delay),
+	}
+	payload.Hostname, _ = os.Hostname()
+
+	if ue, err := updateengine.New(); err == nil {
+		if status, err := ue.GetStatus(); err == nil {
+			payload.CurrentVersion = status.NewVersion
+		}
+	}
+
+	body, err := json.Marshal(&payload)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := http.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// A transient failure to reach the webhook (DNS hiccup, the webhook
+		// service restarting, a timeout) is not the same thing as the
+		// webhook deliberately vetoing the reboot: fail open rather than
+		// stranding the reboot lock because this notifier couldn't be
+		// reached.
+		fmt.Fprintf(os.Stderr, "webhook notifier: error notifying %s, proceeding anyway: %v\n", n.url, err)
+		return true, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, fmt.Errorf("webhook notifier: %s returned %s", n.url, resp.Status)
+	}
+
+	var wr webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&wr); err == nil && wr.Delay != "" {
+		if d, err := time.ParseDuration(wr.Delay); err == nil {
+			fmt.Printf("webhook notifier: %s asked to delay the reboot by %v\n", n.url, d)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	return true, nil
+}
+
+func (n *webhookNotifier) Cancelled(reason string) {
+	body, _ := json.Marshal(map[string]string{"cancelled": reason})
+	resp, err := http.Post(n.url, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// systemdInhibitNotifier takes a "delay" systemd-logind inhibitor lock for
+// the duration of the reboot delay. This only postpones the reboot: a
+// "delay" lock taken by the same process that is about to request the
+// reboot has no effect on whether that reboot proceeds, and login1 does not
+// expose a way for this notifier to learn that some other session wants to
+// veto it outright. A session that needs real veto power has to hold its
+// own inhibitor against systemd-logind directly (e.g. via
+// systemd-inhibit(1)); logind itself enforces that independently of
+// locksmithd when lgn.Reboot is called. PreReboot here returns false only
+// when it cannot take its own inhibitor lock.
+type systemdInhibitNotifier struct {
+	lgn *login1.Conn
+}
+
+func (n *systemdInhibitNotifier) PreReboot(ctx context.Context, delay time.Duration) (bool, error) {
+	lock, err := n.lgn.Inhibit("shutdown", "locksmithd", "Coordinating a locksmith-initiated reboot", "delay")
+	if err != nil {
+		return false, fmt.Errorf("systemd-inhibit notifier: error taking inhibitor lock: %v", err)
+	}
+	defer lock.Close()
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+
+	return true, nil
+}
+
+func (n *systemdInhibitNotifier) Cancelled(reason string) {
+	fmt.Printf("systemd-inhibit notifier: reboot cancelled: %s\n", reason)
+}
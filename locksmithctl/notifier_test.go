@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/locksmith/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// fakeNotifier is a Notifier whose PreReboot result is fixed at
+// construction time, recording whether Cancelled was ever called on it.
+type fakeNotifier struct {
+	proceed   bool
+	err       error
+	cancelled bool
+}
+
+func (f *fakeNotifier) PreReboot(ctx context.Context, delay time.Duration) (bool, error) {
+	return f.proceed, f.err
+}
+
+func (f *fakeNotifier) Cancelled(reason string) {
+	f.cancelled = true
+}
+
+func TestPreRebootAllProceed(t *testing.T) {
+	a := &fakeNotifier{proceed: true}
+	b := &fakeNotifier{proceed: true}
+
+	if !preReboot(context.Background(), []Notifier{a, b}, time.Minute) {
+		t.Fatal("expected preReboot to proceed when every notifier proceeds")
+	}
+	if a.cancelled || b.cancelled {
+		t.Fatal("Cancelled should not be called when nothing vetoes the reboot")
+	}
+}
+
+func TestPreRebootVetoStopsChainAndCancelsConsultedNotifiers(t *testing.T) {
+	a := &fakeNotifier{proceed: true}
+	veto := &fakeNotifier{proceed: false}
+	unconsulted := &fakeNotifier{proceed: true}
+
+	if preReboot(context.Background(), []Notifier{a, veto, unconsulted}, time.Minute) {
+		t.Fatal("expected preReboot to cancel the reboot when a notifier vetoes it")
+	}
+
+	if !a.cancelled {
+		t.Error("notifiers consulted before the veto should be told it was Cancelled")
+	}
+	if !veto.cancelled {
+		t.Error("the vetoing notifier itself should be told it was Cancelled")
+	}
+	if unconsulted.cancelled {
+		t.Error("a notifier never reached because an earlier one vetoed should not be Cancelled")
+	}
+}
+
+func TestPreRebootVetoWithErrorCancels(t *testing.T) {
+	errNotifier := &fakeNotifier{proceed: false, err: errBoom}
+
+	if preReboot(context.Background(), []Notifier{errNotifier}, time.Minute) {
+		t.Fatal("expected preReboot to cancel the reboot when a notifier vetoes with an error")
+	}
+	if !errNotifier.cancelled {
+		t.Error("a notifier that vetoes with an error should still be Cancelled")
+	}
+}
+
+var errBoom = &testError{"boom"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }